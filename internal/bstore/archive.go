@@ -0,0 +1,274 @@
+package bstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+
+	"code.google.com/p/go-uuid/uuid"
+
+	"github.com/SoftwareDefinedBuildings/quasar/internal/sblockstore"
+)
+
+// Archive format:
+//   [16]byte magic+version header: "BTRDBARCHIVEv001"
+//   repeating frames: {recordType(1), uuid(16), gen(8), addr(8), payloadLen(4), payload}
+//   a zero-length footer frame (recordType archiveFooter, all other fields zero)
+//   a trailing 4-byte big-endian CRC32C (Castagnoli) of everything written before it
+//
+// Dump walks from each requested UUID's superblocks (within [sgen, egen))
+// down through the Coreblock tree and emits every Coreblock/Vectorblock it
+// finds exactly once, deduplicated by physical address, followed by the
+// superblock itself. Restore replays the stream into a fresh store,
+// remapping every address via allocateBlock as it goes.
+
+const archiveMagic = "BTRDBARCHIVEv001"
+
+type archiveRecordType byte
+
+const (
+	archiveCoreblock archiveRecordType = iota
+	archiveVectorblock
+	archiveSuperblock
+	archiveFooter
+)
+
+var ErrArchiveCorrupt = errors.New("bstore: corrupt archive stream")
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+type archiveFrame struct {
+	rtype archiveRecordType
+	uuid  uuid.UUID
+	gen   uint64
+	addr  uint64
+	data  []byte
+}
+
+func writeArchiveFrame(w io.Writer, crc *uint32, f archiveFrame) error {
+	hdr := make([]byte, 1+16+8+8+4)
+	hdr[0] = byte(f.rtype)
+	copy(hdr[1:17], f.uuid)
+	binary.BigEndian.PutUint64(hdr[17:25], f.gen)
+	binary.BigEndian.PutUint64(hdr[25:33], f.addr)
+	binary.BigEndian.PutUint32(hdr[33:37], uint32(len(f.data)))
+	*crc = crc32.Update(*crc, crc32cTable, hdr)
+	*crc = crc32.Update(*crc, crc32cTable, f.data)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(f.data)
+	return err
+}
+
+func readArchiveFrame(r io.Reader, crc *uint32) (archiveFrame, error) {
+	hdr := make([]byte, 1+16+8+8+4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return archiveFrame{}, err
+	}
+	f := archiveFrame{
+		rtype: archiveRecordType(hdr[0]),
+		uuid:  uuid.UUID(append([]byte(nil), hdr[1:17]...)),
+		gen:   binary.BigEndian.Uint64(hdr[17:25]),
+		addr:  binary.BigEndian.Uint64(hdr[25:33]),
+	}
+	plen := binary.BigEndian.Uint32(hdr[33:37])
+	*crc = crc32.Update(*crc, crc32cTable, hdr)
+	if plen > 0 {
+		f.data = make([]byte, plen)
+		if _, err := io.ReadFull(r, f.data); err != nil {
+			return archiveFrame{}, err
+		}
+		*crc = crc32.Update(*crc, crc32cTable, f.data)
+	}
+	return f, nil
+}
+
+// Dump serializes the superblocks and every reachable core/vector block for
+// the given UUIDs and generation range [sgen, egen) into a single
+// self-describing archive. It is the portable counterpart to a raw copy of
+// the store's data files: the result can be handed to Restore against any
+// other BlockStore, including one backed by a different StorageProvider.
+func (bs *BlockStore) Dump(w io.Writer, uuids []uuid.UUID, sgen uint64, egen uint64) error {
+	bw := bufio.NewWriter(w)
+	var crc uint32
+	if _, err := bw.WriteString(archiveMagic); err != nil {
+		return err
+	}
+	crc = crc32.Update(crc, crc32cTable, []byte(archiveMagic))
+
+	seen := make(map[uint64]bool)
+	for _, id := range uuids {
+		gens, err := bs.sblocks.ListGenerations(id.String(), sgen, egen)
+		if err != nil {
+			return err
+		}
+		for _, gen := range gens {
+			sb := bs.LoadSuperblock(id, gen)
+			if sb == nil {
+				continue
+			}
+			if err := bs.dumpTree(bw, &crc, id, sb.root, seen); err != nil {
+				return err
+			}
+			if err := writeArchiveFrame(bw, &crc, archiveFrame{
+				rtype: archiveSuperblock,
+				uuid:  id,
+				gen:   sb.gen,
+				addr:  sb.root,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	if err := writeArchiveFrame(bw, &crc, archiveFrame{rtype: archiveFooter}); err != nil {
+		return err
+	}
+	footer := make([]byte, 4)
+	binary.BigEndian.PutUint32(footer, crc)
+	if _, err := bw.Write(footer); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// dumpTree walks the Coreblock tree rooted at addr, emitting every block it
+// has not already emitted (by physical address) exactly once.
+func (bs *BlockStore) dumpTree(w io.Writer, crc *uint32, id uuid.UUID, addr uint64, seen map[uint64]bool) error {
+	if addr == 0 || seen[addr] {
+		return nil
+	}
+	seen[addr] = true
+
+	db := bs.ReadDatablock(addr, 0, 0, 0)
+	buf := block_buf_pool.Get().([]byte)
+	defer block_buf_pool.Put(buf)
+	trimmed := db.Serialize(buf)
+
+	switch cb := db.(type) {
+	case *Coreblock:
+		if err := writeArchiveFrame(w, crc, archiveFrame{
+			rtype: archiveCoreblock,
+			uuid:  id,
+			gen:   cb.Generation,
+			addr:  addr,
+			data:  append([]byte(nil), trimmed...),
+		}); err != nil {
+			return err
+		}
+		for _, child := range cb.Addr {
+			if err := bs.dumpTree(w, crc, id, child, seen); err != nil {
+				return err
+			}
+		}
+	case *Vectorblock:
+		if err := writeArchiveFrame(w, crc, archiveFrame{
+			rtype: archiveVectorblock,
+			uuid:  id,
+			gen:   cb.Generation,
+			addr:  addr,
+			data:  append([]byte(nil), trimmed...),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore reconstructs a stream written by Dump into this store. Every
+// address referenced by the archive is remapped to a freshly allocated one
+// (via allocateBlock), so Restore works even when the destination store
+// already has data occupying the old addresses.
+//
+// Dump writes frames pre-order (a Coreblock always precedes its children),
+// so a single pass can't rewrite child pointers as it replays: the child's
+// new address isn't known yet when its parent is processed. Restore instead
+// buffers the block frames, allocates every new address up front, and only
+// then rewrites and writes the blocks out, so remap is complete by the time
+// any Coreblock's children are looked up.
+func (bs *BlockStore) Restore(r io.Reader) error {
+	magic := make([]byte, len(archiveMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return err
+	}
+	if string(magic) != archiveMagic {
+		return ErrArchiveCorrupt
+	}
+	var crc uint32 = crc32.Update(0, crc32cTable, magic)
+
+	var blocks []archiveFrame
+	var superblocks []archiveFrame
+	for {
+		f, err := readArchiveFrame(r, &crc)
+		if err != nil {
+			return err
+		}
+		if f.rtype == archiveFooter {
+			break
+		}
+		switch f.rtype {
+		case archiveCoreblock, archiveVectorblock:
+			blocks = append(blocks, f)
+		case archiveSuperblock:
+			superblocks = append(superblocks, f)
+		}
+	}
+
+	footer := make([]byte, 4)
+	if _, err := io.ReadFull(r, footer); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(footer) != crc {
+		return ErrArchiveCorrupt
+	}
+
+	remap := make(map[uint64]uint64, len(blocks))
+	for _, b := range blocks {
+		remap[b.addr] = bs.allocateBlock()
+	}
+
+	for _, b := range blocks {
+		buf := block_buf_pool.Get().([]byte)
+		var trimmed []byte
+		switch b.rtype {
+		case archiveCoreblock:
+			cb := &Coreblock{}
+			cb.Deserialize(b.data)
+			for i, child := range cb.Addr {
+				if child == 0 {
+					continue
+				}
+				if newChild, ok := remap[child]; ok {
+					cb.Addr[i] = newChild
+				}
+			}
+			trimmed = cb.Serialize(buf)
+		case archiveVectorblock:
+			vb := &Vectorblock{}
+			vb.Deserialize(b.data)
+			trimmed = vb.Serialize(buf)
+		}
+		err := bs.store.Write(remap[b.addr], trimmed)
+		block_buf_pool.Put(buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, f := range superblocks {
+		newRoot, ok := remap[f.addr]
+		if !ok {
+			newRoot = f.addr
+		}
+		sb := &sblockstore.SBlock{
+			Uuid: f.uuid.String(),
+			Gen:  f.gen,
+			Root: newRoot,
+		}
+		if err := bs.sblocks.Insert(sb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
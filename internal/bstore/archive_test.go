@@ -0,0 +1,88 @@
+package bstore
+
+import (
+	"bytes"
+	"testing"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+func newTestBlockStore(t *testing.T) *BlockStore {
+	t.Helper()
+	bs, err := NewBlockStore("", 64, t.TempDir(), map[string]string{
+		"sblockstore": "embedded",
+		"provider":    "file",
+	})
+	if err != nil {
+		t.Fatalf("NewBlockStore: %v", err)
+	}
+	return bs
+}
+
+// TestDumpRestoreRoundTrip commits two generations of the same stream that
+// share a Vectorblock (the second generation's Coreblock points at the same
+// leaf the first one wrote, the way a real COW commit that doesn't touch
+// every leaf would), dumps both generations, and restores them into a fresh
+// store. It checks that the shared leaf is remapped to one new address
+// (dedup by physical address in dumpTree) and that both restored
+// generations' roots still point at it.
+func TestDumpRestoreRoundTrip(t *testing.T) {
+	src := newTestBlockStore(t)
+	id := uuid.NewRandom()
+
+	gen1 := src.ObtainGeneration(id)
+	leaf, err := gen1.AllocateVectorblock()
+	if err != nil {
+		t.Fatalf("AllocateVectorblock: %v", err)
+	}
+	root1, err := gen1.AllocateCoreblock()
+	if err != nil {
+		t.Fatalf("AllocateCoreblock: %v", err)
+	}
+	root1.Addr[0] = leaf.Identifier
+	gen1.UpdateRootAddr(root1.Identifier)
+	if _, err := gen1.Commit(); err != nil {
+		t.Fatalf("Commit gen1: %v", err)
+	}
+
+	gen2 := src.ObtainGeneration(id)
+	root2, err := gen2.AllocateCoreblock()
+	if err != nil {
+		t.Fatalf("AllocateCoreblock: %v", err)
+	}
+	root2.Addr[0] = leaf.Identifier
+	gen2.UpdateRootAddr(root2.Identifier)
+	if _, err := gen2.Commit(); err != nil {
+		t.Fatalf("Commit gen2: %v", err)
+	}
+
+	var archive bytes.Buffer
+	if err := src.Dump(&archive, []uuid.UUID{id}, 0, LatestGeneration); err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+
+	dst := newTestBlockStore(t)
+	if err := dst.Restore(bytes.NewReader(archive.Bytes())); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+
+	sb1 := dst.LoadSuperblock(id, 1)
+	sb2 := dst.LoadSuperblock(id, 2)
+	if sb1 == nil || sb2 == nil {
+		t.Fatalf("expected both generations restored, got gen1=%v gen2=%v", sb1, sb2)
+	}
+
+	restoredRoot1 := dst.ReadDatablock(sb1.root, 0, 0, 0).(*Coreblock)
+	restoredRoot2 := dst.ReadDatablock(sb2.root, 0, 0, 0).(*Coreblock)
+	if restoredRoot1.Addr[0] == 0 || restoredRoot1.Addr[0] != restoredRoot2.Addr[0] {
+		t.Fatalf("shared leaf not remapped consistently: gen1 -> %v, gen2 -> %v", restoredRoot1.Addr[0], restoredRoot2.Addr[0])
+	}
+	if restoredRoot1.Addr[0] == leaf.Identifier {
+		t.Fatalf("leaf address %v was not remapped by Restore", leaf.Identifier)
+	}
+
+	restoredLeaf := dst.ReadDatablock(restoredRoot1.Addr[0], 0, 0, 0).(*Vectorblock)
+	if restoredLeaf == nil {
+		t.Fatalf("restored leaf not found at remapped address")
+	}
+}
@@ -3,13 +3,16 @@ package bstore
 import (
 	"code.google.com/p/go-uuid/uuid"
 	"errors"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 	"github.com/SoftwareDefinedBuildings/quasar/internal/bprovider"
+	"github.com/SoftwareDefinedBuildings/quasar/internal/compressedprovider"
 	"github.com/SoftwareDefinedBuildings/quasar/internal/fileprovider"
+	"github.com/SoftwareDefinedBuildings/quasar/internal/s3provider"
+	"github.com/SoftwareDefinedBuildings/quasar/internal/sblockstore"
 )
 
 const LatestGeneration = uint64(^(uint64(0)))
@@ -21,31 +24,196 @@ func UUIDToMapKey(id uuid.UUID) [16]byte {
 }
 
 type BlockStore struct {
-	ses     *mgo.Session
-	db      *mgo.Database
+	sblocks sblockstore.SuperblockStore
 	_wlocks map[[16]byte]*sync.Mutex
 	glock   sync.RWMutex
-	
+
 	basepath string
 	metaLock sync.Mutex
-	
+
 	cachemap map[uint64]*CacheItem
 	cacheold *CacheItem
 	cachenew *CacheItem
 	cachemtx sync.Mutex
 	cachelen uint64
 	cachemax uint64
-	
+
 	store	 bprovider.StorageProvider
-	alloc chan uint64
+
+	allocMtx   sync.Mutex
+	allocFree  []uint64
+	allocNext  uint64
+	allocLimit uint64
+
+	genfree    map[[16]byte]*genFreelist
+	genfreeMtx sync.Mutex
 }
 
+// allocBatchSize is how many addresses the allocator reserves (and persists
+// the new high-water mark for) at a time, so a crash wastes at most one
+// batch's worth of addresses rather than resetting to RELOCATION_BASE.
+const allocBatchSize = 4096
+
 var block_buf_pool = sync.Pool{
 	New: func() interface{} {
 		return make([]byte, DBSIZE)
 	},
 }
 
+var coreblock_pool = sync.Pool{
+	New: func() interface{} {
+		return &Coreblock{}
+	},
+}
+
+var vectorblock_pool = sync.Pool{
+	New: func() interface{} {
+		return &Vectorblock{}
+	},
+}
+
+// CacheItem is one entry in a BlockStore's cachemap, doubly-linked into the
+// cacheold (LRU)..cachenew (MRU) list so cachePut can evict in O(1).
+type CacheItem struct {
+	addr  uint64
+	value Datablock
+	prev  *CacheItem
+	next  *CacheItem
+}
+
+// initCache prepares an empty, max-sized LRU cache of read-through
+// core/vector blocks, keyed by physical address.
+func (bs *BlockStore) initCache(max uint64) {
+	bs.cachemap = make(map[uint64]*CacheItem)
+	bs.cachemax = max
+}
+
+// cacheUnlink removes item from the LRU list without touching cachemap.
+// Caller must hold cachemtx.
+func (bs *BlockStore) cacheUnlink(item *CacheItem) {
+	if item.prev != nil {
+		item.prev.next = item.next
+	} else {
+		bs.cacheold = item.next
+	}
+	if item.next != nil {
+		item.next.prev = item.prev
+	} else {
+		bs.cachenew = item.prev
+	}
+	item.prev = nil
+	item.next = nil
+}
+
+// cachePushNew links item in as the most-recently-used entry. Caller must
+// hold cachemtx.
+func (bs *BlockStore) cachePushNew(item *CacheItem) {
+	item.prev = bs.cachenew
+	item.next = nil
+	if bs.cachenew != nil {
+		bs.cachenew.next = item
+	}
+	bs.cachenew = item
+	if bs.cacheold == nil {
+		bs.cacheold = item
+	}
+}
+
+// cacheGet returns the cached block at addr, promoting it to
+// most-recently-used, or nil on a cache miss.
+func (bs *BlockStore) cacheGet(addr uint64) Datablock {
+	bs.cachemtx.Lock()
+	defer bs.cachemtx.Unlock()
+	item, ok := bs.cachemap[addr]
+	if !ok {
+		return nil
+	}
+	bs.cacheUnlink(item)
+	bs.cachePushNew(item)
+	return item.value
+}
+
+// cachePut inserts or updates the cached block at addr and, if that pushes
+// the cache over cachemax, evicts least-recently-used entries down to the
+// limit. Evicted entries are simply dropped, not pooled: ReadDatablock hands
+// the very pointer it caches to its caller, with nothing tracking whether
+// that caller is still using it, so an evicted block can't be recycled by
+// the pool without risking a live reader's data getting zeroed out from
+// under it. Letting the GC collect them is the safe default; only code that
+// explicitly relinquishes a block (FreeCoreblock/FreeVectorblock, Commit)
+// may pool it.
+func (bs *BlockStore) cachePut(addr uint64, db Datablock) {
+	bs.cachemtx.Lock()
+	defer bs.cachemtx.Unlock()
+	if item, ok := bs.cachemap[addr]; ok {
+		item.value = db
+		bs.cacheUnlink(item)
+		bs.cachePushNew(item)
+		return
+	}
+	item := &CacheItem{addr: addr, value: db}
+	bs.cachemap[addr] = item
+	bs.cachePushNew(item)
+	bs.cachelen++
+	for bs.cachelen > bs.cachemax && bs.cacheold != nil {
+		victim := bs.cacheold
+		bs.cacheUnlink(victim)
+		delete(bs.cachemap, victim.addr)
+		bs.cachelen--
+	}
+}
+
+// cacheRemove drops addr from the cache, if present, without pooling its
+// block. Callers that are about to free or mutate a block themselves (e.g.
+// FreeCoreblock, Commit) must call this first so a concurrent ReadDatablock
+// can't hand out a cache hit that's aliasing a block already back in the
+// pool.
+func (bs *BlockStore) cacheRemove(addr uint64) {
+	bs.cachemtx.Lock()
+	if item, ok := bs.cachemap[addr]; ok {
+		bs.cacheUnlink(item)
+		delete(bs.cachemap, addr)
+		bs.cachelen--
+	}
+	bs.cachemtx.Unlock()
+}
+
+// genFreelist holds the slice backing arrays from a finished Generation so
+// the next one opened for the same UUID can reuse their capacity instead of
+// allocating fresh 8192-entry slices.
+type genFreelist struct {
+	cblocks      []*Coreblock
+	vblocks      []*Vectorblock
+	unref_vaddrs []uint64
+}
+
+// takeGenFreelist pops (or manufactures) the slices to use for a new
+// Generation on the given UUID.
+func (bs *BlockStore) takeGenFreelist(mk [16]byte) *genFreelist {
+	bs.genfreeMtx.Lock()
+	fl, ok := bs.genfree[mk]
+	if ok {
+		delete(bs.genfree, mk)
+	}
+	bs.genfreeMtx.Unlock()
+	if ok {
+		return fl
+	}
+	return &genFreelist{
+		cblocks:      make([]*Coreblock, 0, 8192),
+		vblocks:      make([]*Vectorblock, 0, 8192),
+		unref_vaddrs: make([]uint64, 0, 8192),
+	}
+}
+
+// giveGenFreelist returns a finished Generation's (now-empty) slices so the
+// next Generation on the same UUID can reuse their backing arrays.
+func (bs *BlockStore) giveGenFreelist(mk [16]byte, fl *genFreelist) {
+	bs.genfreeMtx.Lock()
+	bs.genfree[mk] = fl
+	bs.genfreeMtx.Unlock()
+}
+
 var ErrDatablockNotFound = errors.New("Coreblock not found")
 var ErrGenerationNotFound = errors.New("Generation not found")
 
@@ -79,51 +247,93 @@ func (g *Generation) UnreferenceBlock(vaddr uint64) {
 }
 
 func (bs *BlockStore) UnlinkGenerations(id uuid.UUID, sgen uint64, egen uint64) error {
-	iter := bs.db.C("superblocks").Find(bson.M{"uuid": id.String(), "gen": bson.M{"$gte": sgen, "$lt": egen}, "unlinked": false}).Iter()
-	rs := fake_sblock{}
-	for iter.Next(&rs) {
-		rs.Unlinked = true
-		_, err := bs.db.C("superblocks").Upsert(bson.M{"uuid": id.String(), "gen": rs.Gen}, rs)
-		if err != nil {
-			log.Panic(err)
+	roots, err := bs.sblocks.RangeUnlink(id.String(), sgen, egen)
+	if err != nil {
+		return err
+	}
+	return bs.sblocks.PushFree(roots)
+}
+// newStorageProvider picks and initializes the bprovider.StorageProvider
+// named by params["provider"] ("file", "s3" or "compressed"). It defaults to
+// "file" so existing callers that only ever knew about the file provider
+// keep working unmodified. "compressed" wraps whichever provider is named by
+// params["compressed_provider"] (again defaulting to "file") with a
+// transparent zstd layer.
+func newStorageProvider(params map[string]string) bprovider.StorageProvider {
+	kind, ok := params["provider"]
+	if !ok {
+		kind = "file"
+	}
+	switch kind {
+	case "file":
+		return new(fileprovider.FileStorageProvider)
+	case "s3":
+		return new(s3provider.S3StorageProvider)
+	case "compressed":
+		inner := params["compressed_provider"]
+		if inner == "" {
+			inner = "file"
 		}
+		wrapped := newStorageProvider(map[string]string{"provider": inner})
+		return compressedprovider.NewCompressedProvider(wrapped)
+	default:
+		log.Panic("unknown storage provider %q", kind)
+		return nil
+	}
+}
+
+// newSuperblockStore picks and opens the sblockstore.SuperblockStore named by
+// params["sblockstore"] ("mongo" or "embedded"). It defaults to "mongo" so
+// existing deployments keep pointing at targetserv unmodified. "embedded"
+// opens a BoltDB file under dbpath instead, so btrdb can run (and be tested)
+// without an external Mongo.
+func newSuperblockStore(targetserv string, dbpath string, params map[string]string) (sblockstore.SuperblockStore, error) {
+	kind, ok := params["sblockstore"]
+	if !ok {
+		kind = "mongo"
+	}
+	switch kind {
+	case "mongo":
+		return sblockstore.NewMongoSuperblockStore(targetserv)
+	case "embedded":
+		return sblockstore.NewBoltSuperblockStore(filepath.Join(dbpath, "superblocks.bolt"))
+	default:
+		return nil, errors.New("bstore: unknown sblockstore kind " + kind)
 	}
-	return nil
 }
-func NewBlockStore(targetserv string, cachesize uint64, dbpath string) (*BlockStore, error) {
-	//TODO make the args to this function a map
+
+func NewBlockStore(targetserv string, cachesize uint64, dbpath string, params map[string]string) (*BlockStore, error) {
 	bs := BlockStore{}
-	ses, err := mgo.Dial(targetserv)
+	if params == nil {
+		params = map[string]string{}
+	}
+	sblocks, err := newSuperblockStore(targetserv, dbpath, params)
 	if err != nil {
 		return nil, err
 	}
-	bs.ses = ses
-	bs.db = ses.DB("quasar2")
+	bs.sblocks = sblocks
 	bs._wlocks = make(map[[16]byte]*sync.Mutex)
+	bs.genfree = make(map[[16]byte]*genFreelist)
 	bs.basepath = dbpath
 	if err := os.MkdirAll(bs.basepath, 0755); err != nil {
 		log.Panic(err)
 	}
-	
-	bs.alloc = make(chan uint64, 256)
-	go func (){
-		relocation_addr := uint64(RELOCATION_BASE)
-		for {
-			bs.alloc <- relocation_addr
-			relocation_addr += 1
-			if relocation_addr < RELOCATION_BASE {
-				relocation_addr = RELOCATION_BASE
-			}
-		}
-	} ()
-	
-	bs.store = new(fileprovider.FileStorageProvider)
-	params := map[string]string {
-		"dbpath":dbpath,
+
+	if _, ok := params["dbpath"]; !ok {
+		params["dbpath"] = dbpath
+	}
+	if _, ok := params["blocksize"]; !ok {
+		// The compressed provider pads every block out to this size before
+		// handing it to its wrapped provider, so it must match DBSIZE or the
+		// fixed addr*DBSIZE slots a file-backed provider writes into overlap.
+		params["blocksize"] = strconv.Itoa(DBSIZE)
+	}
+	bs.store = newStorageProvider(params)
+	if err := bs.store.Initialize(params); err != nil {
+		return nil, err
 	}
-	bs.store.Initialize(params)
 	bs.initCache(cachesize)
-	
+
 	return &bs, nil
 }
 
@@ -148,16 +358,15 @@ func (bs *BlockStore) ObtainGeneration(id uuid.UUID) *Generation {
 		mtx.Lock()
 	}
 
+	fl := bs.takeGenFreelist(mk)
 	gen := &Generation{
-		cblocks:      make([]*Coreblock, 0, 8192),
-		vblocks:      make([]*Vectorblock, 0, 8192),
-		unref_vaddrs: make([]uint64, 0, 8192),
+		cblocks:      fl.cblocks,
+		vblocks:      fl.vblocks,
+		unref_vaddrs: fl.unref_vaddrs,
 	}
 	//We need a generation. Lets see if one is on disk
-	qry := bs.db.C("superblocks").Find(bson.M{"uuid": id.String()})
-	rs := fake_sblock{}
-	qerr := qry.Sort("-gen").One(&rs)
-	if qerr == mgo.ErrNotFound {
+	rs, qerr := bs.sblocks.LatestFor(id.String())
+	if qerr == sblockstore.ErrNotFound {
 		log.Info("no superblock found for %v", id.String())
 		//Ok just create a new superblock/generation
 		gen.Cur_SB = NewSuperblock(id)
@@ -190,23 +399,41 @@ func (gen *Generation) Commit() (map[uint64]uint64, error) {
 	then := time.Now()
 	address_map := LinkAndStore(gen.blockstore.store, gen.vblocks, gen.cblocks)
 	dt := time.Now().Sub(then)
-	log.Info("(LAS %dus %dbx) ins blk u=%v gen=%v root=%v", 
+	log.Info("(LAS %dus %dbx) ins blk u=%v gen=%v root=%v",
 		uint64(dt / time.Microsecond), len(gen.vblocks) + len(gen.cblocks), gen.Uuid().String(), gen.Number(), gen.New_SB.root)
+
+	for _, cb := range gen.cblocks {
+		gen.blockstore.cacheRemove(cb.Identifier)
+		coreblock_pool.Put(cb)
+	}
+	for _, vb := range gen.vblocks {
+		gen.blockstore.cacheRemove(vb.Identifier)
+		vectorblock_pool.Put(vb)
+	}
+	if err := gen.blockstore.sblocks.PushFree(gen.unref_vaddrs); err != nil {
+		log.Panic(err)
+	}
+	mk := UUIDToMapKey(*gen.Uuid())
+	gen.blockstore.giveGenFreelist(mk, &genFreelist{
+		cblocks:      gen.cblocks[:0],
+		vblocks:      gen.vblocks[:0],
+		unref_vaddrs: gen.unref_vaddrs[:0],
+	})
 	gen.vblocks = nil
 	gen.cblocks = nil
-	
+	gen.unref_vaddrs = nil
+
 	rootaddr, ok := address_map[gen.New_SB.root]
 	if !ok {
 		log.Panic("Could not obtain root address")
 	}
 	gen.New_SB.root = rootaddr
-	//XXX TODO XTAG must add unreferenced list to superblock
-	fsb := fake_sblock{
-		Uuid:  gen.New_SB.uuid.String(),
-		Gen:   gen.New_SB.gen,
-		Root:  gen.New_SB.root,
+	sb := &sblockstore.SBlock{
+		Uuid: gen.New_SB.uuid.String(),
+		Gen:  gen.New_SB.gen,
+		Root: gen.New_SB.root,
 	}
-	if err := gen.blockstore.db.C("superblocks").Insert(fsb); err != nil {
+	if err := gen.blockstore.sblocks.Insert(sb); err != nil {
 		log.Panic(err)
 	}
 	gen.flushed = true
@@ -230,9 +457,68 @@ func (bs *BlockStore) datablockBarrier(fi int) {
 	//bs.ses.Fsync(false)
 }
 
+// allocateBlock hands out a physical address for a new block: first it
+// drains the in-memory cache of addresses popped from the persisted free
+// list (freed by UnreferenceBlock/UnlinkGenerations), then the rest of its
+// current batch; only once both are used up does it pop the free list again
+// and, if that is empty too, reserve a fresh batch of allocBatchSize
+// addresses past the persisted high-water mark.
 func (bs *BlockStore) allocateBlock() uint64 {
-	relocation_address := <-bs.alloc
-	return relocation_address
+	bs.allocMtx.Lock()
+	defer bs.allocMtx.Unlock()
+
+	if len(bs.allocFree) == 0 && bs.allocNext >= bs.allocLimit {
+		free, err := bs.sblocks.PopFree(allocBatchSize)
+		if err != nil {
+			log.Panic(err)
+		}
+		bs.allocFree = free
+	}
+	if len(bs.allocFree) > 0 {
+		addr := bs.allocFree[len(bs.allocFree)-1]
+		bs.allocFree = bs.allocFree[:len(bs.allocFree)-1]
+		return addr
+	}
+
+	if bs.allocNext >= bs.allocLimit {
+		base, err := bs.sblocks.AdvanceHighWater(RELOCATION_BASE, allocBatchSize)
+		if err != nil {
+			log.Panic(err)
+		}
+		bs.allocNext = base
+		bs.allocLimit = base + allocBatchSize
+	}
+
+	addr := bs.allocNext
+	bs.allocNext++
+	return addr
+}
+
+// AllocatorStats reports the allocator's current used/free/high-water
+// counts, for operators to monitor fragmentation.
+type AllocatorStats struct {
+	Used      uint64
+	Free      uint64
+	HighWater uint64
+}
+
+func (bs *BlockStore) AllocatorStats() AllocatorStats {
+	bs.allocMtx.Lock()
+	highWater := bs.allocLimit
+	inMemFree := uint64(len(bs.allocFree))
+	bs.allocMtx.Unlock()
+
+	persistedFree, err := bs.sblocks.FreeCount()
+	if err != nil {
+		log.Panic(err)
+	}
+	free := inMemFree + uint64(persistedFree)
+
+	var used uint64
+	if highWater > RELOCATION_BASE+free {
+		used = highWater - RELOCATION_BASE - free
+	}
+	return AllocatorStats{Used: used, Free: free, HighWater: highWater}
 }
 
 /**
@@ -242,7 +528,8 @@ func (bs *BlockStore) allocateBlock() uint64 {
  * This stub makes up an address, and mongo pretends its real
  */
 func (gen *Generation) AllocateCoreblock() (*Coreblock, error) {
-	cblock := &Coreblock{}
+	cblock := coreblock_pool.Get().(*Coreblock)
+	*cblock = Coreblock{}
 	cblock.Identifier = gen.blockstore.allocateBlock()
 	cblock.Generation = gen.Number()
 	gen.cblocks = append(gen.cblocks, cblock)
@@ -250,32 +537,37 @@ func (gen *Generation) AllocateCoreblock() (*Coreblock, error) {
 }
 
 func (gen *Generation) AllocateVectorblock() (*Vectorblock, error) {
-	vblock := &Vectorblock{}
+	vblock := vectorblock_pool.Get().(*Vectorblock)
+	*vblock = Vectorblock{}
 	vblock.Identifier = gen.blockstore.allocateBlock()
 	vblock.Generation = gen.Number()
 	gen.vblocks = append(gen.vblocks, vblock)
 	return vblock, nil
 }
 
+// FreeCoreblock returns cb to the coreblock pool so a later
+// AllocateCoreblock/ReadDatablock can reuse it instead of the GC having to
+// collect and the allocator having to zero a fresh one. It first drops cb
+// from the read cache so a racing ReadDatablock can't hand back a pointer
+// that's simultaneously sitting on the pool's free list.
 func (bs *BlockStore) FreeCoreblock(cb **Coreblock) {
+	bs.cacheRemove((*cb).Identifier)
+	coreblock_pool.Put(*cb)
 	*cb = nil
 }
 
+// FreeVectorblock returns vb to the vectorblock pool; see FreeCoreblock.
 func (bs *BlockStore) FreeVectorblock(vb **Vectorblock) {
+	bs.cacheRemove((*vb).Identifier)
+	vectorblock_pool.Put(*vb)
 	*vb = nil
 }
 
 func (bs *BlockStore) DEBUG_DELETE_UUID(id uuid.UUID) {
 	log.Info("DEBUG removing uuid '%v' from database", id.String())
-	_, err := bs.db.C("superblocks").RemoveAll(bson.M{"uuid": id.String()})
-	if err != nil && err != mgo.ErrNotFound {
+	if err := bs.sblocks.DeleteUUID(id.String()); err != nil {
 		log.Panic(err)
 	}
-	if err == mgo.ErrNotFound {
-		log.Info("Quey did not find supeblock to delete")
-	} else {
-		log.Info("err was nik")
-	}
 	//bs.datablockBarrier()
 }
 
@@ -345,7 +637,8 @@ func (bs *BlockStore) ReadDatablock(addr uint64, impl_Generation uint64, impl_Po
 	trimbuf := bs.store.Read(addr, syncbuf)
 	switch DatablockGetBufferType(trimbuf) {
 	case Core:
-		rv := &Coreblock{}
+		rv := coreblock_pool.Get().(*Coreblock)
+		*rv = Coreblock{}
 		rv.Deserialize(trimbuf)
 		block_buf_pool.Put(syncbuf)
 		rv.Identifier = addr
@@ -355,7 +648,8 @@ func (bs *BlockStore) ReadDatablock(addr uint64, impl_Generation uint64, impl_Po
 		bs.cachePut(addr, rv)
 		return rv
 	case Vector:
-		rv := &Vectorblock{}
+		rv := vectorblock_pool.Get().(*Vectorblock)
+		*rv = Vectorblock{}
 		rv.Deserialize(trimbuf)
 		block_buf_pool.Put(syncbuf)
 		rv.Identifier = addr
@@ -369,35 +663,20 @@ func (bs *BlockStore) ReadDatablock(addr uint64, impl_Generation uint64, impl_Po
 	return nil
 }
 
-type fake_sblock struct {
-	Uuid     string
-	Gen      uint64
-	Root     uint64
-	Unlinked bool
-}
-
 func (bs *BlockStore) LoadSuperblock(id uuid.UUID, generation uint64) *Superblock {
-	var sb = fake_sblock{}
+	var sb *sblockstore.SBlock
+	var err error
 	if generation == LatestGeneration {
 		log.Info("loading superblock uuid=%v (lgen)", id.String())
-		qry := bs.db.C("superblocks").Find(bson.M{"uuid": id.String()})
-		if err := qry.Sort("-gen").One(&sb); err != nil {
-			if err == mgo.ErrNotFound {
-				log.Info("sb notfound!")
-				return nil
-			} else {
-				log.Panic(err)
-			}
-		}
+		sb, err = bs.sblocks.LatestFor(id.String())
 	} else {
-		qry := bs.db.C("superblocks").Find(bson.M{"uuid": id.String(), "gen": generation})
-		if err := qry.One(&sb); err != nil {
-			if err == mgo.ErrNotFound {
-				return nil
-			} else {
-				log.Panic(err)
-			}
-		}
+		sb, err = bs.sblocks.Get(id.String(), generation)
+	}
+	if err == sblockstore.ErrNotFound {
+		log.Info("sb notfound!")
+		return nil
+	} else if err != nil {
+		log.Panic(err)
 	}
 	rv := Superblock{
 		uuid:     id,
@@ -0,0 +1,123 @@
+package compressedprovider
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/SoftwareDefinedBuildings/quasar/internal/bprovider"
+)
+
+// defaultBlockSize is used only if the caller's params don't specify one.
+// bstore.NewBlockStore always passes params["blocksize"] set to its own
+// DBSIZE (compressedprovider can't import bstore to reference that constant
+// directly without a cycle), since the padded, on-disk blocks this wrapper
+// writes must line up with the fixed addr*DBSIZE slots a file-backed
+// provider writes into.
+const defaultBlockSize = 65536
+
+const (
+	tagPlain      byte = 0
+	tagCompressed byte = 1
+	headerLen          = 1 + 4
+)
+
+var ErrCorruptBlock = errors.New("compressedprovider: corrupt block tag")
+
+// CompressedProvider wraps another bprovider.StorageProvider and transparently
+// zstd-compresses each block on write, decompressing it again on read. Every
+// block written through the wrapper carries a 1-byte tag (tagPlain or
+// tagCompressed) ahead of its payload, and Read strips it. Blocks written by
+// the wrapped provider directly, without this wrapper, carry no tag: Read
+// panics with ErrCorruptBlock on them, or misreads one whose first byte
+// happens to equal a tag. Likewise, reading tagged blocks without the
+// wrapper returns the tag and any compression along with the data.
+type CompressedProvider struct {
+	inner     bprovider.StorageProvider
+	encoder   *zstd.Encoder
+	decoder   *zstd.Decoder
+	blockSize int
+}
+
+// NewCompressedProvider wraps inner with a transparent compression layer.
+func NewCompressedProvider(inner bprovider.StorageProvider) *CompressedProvider {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		panic(err)
+	}
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		panic(err)
+	}
+	return &CompressedProvider{
+		inner:   inner,
+		encoder: enc,
+		decoder: dec,
+	}
+}
+
+func (cp *CompressedProvider) Initialize(params map[string]string) error {
+	if err := cp.inner.Initialize(params); err != nil {
+		return err
+	}
+	cp.blockSize = defaultBlockSize
+	if bs, ok := params["blocksize"]; ok {
+		n, err := strconv.Atoi(bs)
+		if err != nil {
+			return err
+		}
+		cp.blockSize = n
+	}
+	return nil
+}
+
+// Write compresses data (the trimmed, logical block contents) and hands the
+// wrapped provider a DBSIZE buffer: [tag][4-byte compressed length][zstd
+// bytes][zero padding out to blockSize], or, if compression didn't buy us
+// anything, [tag=plain][raw data]. The compressed length (not the logical,
+// uncompressed one) has to be recorded so Read knows where the zstd frame
+// ends and the trailing zero padding begins — a zstd frame can legitimately
+// end in 0x00, so handing the padding to the decoder along with it is not
+// safe. data must leave room for the 1-byte plain-path tag; anything that
+// doesn't fit is rejected rather than silently truncated.
+func (cp *CompressedProvider) Write(address uint64, data []byte) error {
+	if len(data) > cp.blockSize-1 {
+		return fmt.Errorf("compressedprovider: block of %d bytes exceeds blocksize %d", len(data), cp.blockSize)
+	}
+	compressed := cp.encoder.EncodeAll(data, make([]byte, 0, len(data)))
+	out := make([]byte, cp.blockSize)
+	if len(compressed)+headerLen < len(data) {
+		out[0] = tagCompressed
+		binary.LittleEndian.PutUint32(out[1:headerLen], uint32(len(compressed)))
+		copy(out[headerLen:], compressed)
+	} else {
+		out[0] = tagPlain
+		copy(out[1:], data)
+	}
+	return cp.inner.Write(address, out)
+}
+
+// Read returns the logical block bytes regardless of whether the on-disk
+// representation is compressed or plain.
+func (cp *CompressedProvider) Read(address uint64, buf []byte) []byte {
+	raw := cp.inner.Read(address, buf)
+	if len(raw) == 0 {
+		return raw
+	}
+	switch raw[0] {
+	case tagCompressed:
+		clen := int(binary.LittleEndian.Uint32(raw[1:headerLen]))
+		decoded, err := cp.decoder.DecodeAll(raw[headerLen:headerLen+clen], nil)
+		if err != nil {
+			panic(err)
+		}
+		return decoded
+	case tagPlain:
+		return raw[1:]
+	default:
+		panic(ErrCorruptBlock)
+	}
+}
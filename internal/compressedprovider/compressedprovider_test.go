@@ -0,0 +1,85 @@
+package compressedprovider
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// memProvider is a minimal in-memory bprovider.StorageProvider, just enough
+// to drive CompressedProvider through a real Write/Read round trip without
+// touching disk.
+type memProvider struct {
+	blocks map[uint64][]byte
+}
+
+func (m *memProvider) Initialize(params map[string]string) error {
+	m.blocks = make(map[uint64][]byte)
+	return nil
+}
+
+func (m *memProvider) Write(address uint64, data []byte) error {
+	m.blocks[address] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *memProvider) Read(address uint64, buf []byte) []byte {
+	return m.blocks[address]
+}
+
+func newTestProvider(t *testing.T) *CompressedProvider {
+	t.Helper()
+	cp := NewCompressedProvider(&memProvider{})
+	if err := cp.Initialize(map[string]string{"blocksize": "256"}); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	return cp
+}
+
+// TestCompressedProviderRoundTrip covers both the compressed and plain
+// on-disk paths. Highly compressible data (a run of zero bytes) takes the
+// compressed path; incompressible random data, which zstd can't shrink by
+// more than headerLen bytes, falls back to the plain path. The compressed path must
+// read back byte-for-byte identical to what was written — this is the case
+// that would have caught the padding bug where the header recorded the
+// uncompressed length instead of the compressed one.
+func TestCompressedProviderRoundTrip(t *testing.T) {
+	cp := newTestProvider(t)
+
+	compressible := bytes.Repeat([]byte{0}, 200)
+	if err := cp.Write(1, compressible); err != nil {
+		t.Fatalf("Write(compressible): %v", err)
+	}
+	got := cp.Read(1, make([]byte, cp.blockSize))
+	if !bytes.Equal(got, compressible) {
+		t.Fatalf("Read(compressible): got %d bytes, want %d bytes matching input", len(got), len(compressible))
+	}
+
+	// The plain path carries no length of its own (unlike the compressed
+	// path's 4-byte header), so Read hands back the rest of the on-disk
+	// block rather than trimming to what was written — callers only ever
+	// see this through Datablock.Deserialize, whose wire format is
+	// self-describing and ignores the trailing zero padding. A round trip
+	// through the plain path is therefore checked by prefix, not exact
+	// length.
+	incompressible := make([]byte, 200)
+	rand.New(rand.NewSource(1)).Read(incompressible)
+	if err := cp.Write(2, incompressible); err != nil {
+		t.Fatalf("Write(incompressible): %v", err)
+	}
+	got = cp.Read(2, make([]byte, cp.blockSize))
+	if len(got) < len(incompressible) || !bytes.Equal(got[:len(incompressible)], incompressible) {
+		t.Fatalf("Read(incompressible): got %d bytes, want a prefix matching the %d written bytes", len(got), len(incompressible))
+	}
+}
+
+// TestCompressedProviderRejectsOversizedBlock checks that data which can't
+// fit alongside the 1-byte plain-path tag is rejected up front rather than
+// silently truncated.
+func TestCompressedProviderRejectsOversizedBlock(t *testing.T) {
+	cp := newTestProvider(t)
+	oversized := make([]byte, cp.blockSize)
+	if err := cp.Write(1, oversized); err == nil {
+		t.Fatalf("Write(oversized): got nil error, want a rejection")
+	}
+}
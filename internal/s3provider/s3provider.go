@@ -0,0 +1,81 @@
+package s3provider
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/SoftwareDefinedBuildings/quasar/internal/bprovider"
+)
+
+// S3StorageProvider is a bprovider.StorageProvider backed by an S3 (or any
+// S3-compatible HTTP object store) bucket, addressing each block by its
+// uint64 physical address. It speaks plain HTTP PUT/GET against
+// "<endpoint>/<bucket>/<address>" rather than depending on a full S3 SDK, so
+// it works unmodified against anything that implements the same
+// path-style object addressing (S3, Minio, GCS's S3-compatibility layer).
+type S3StorageProvider struct {
+	endpoint string
+	bucket   string
+	client   *http.Client
+}
+
+var _ bprovider.StorageProvider = &S3StorageProvider{}
+
+// Initialize reads "endpoint" and "bucket" out of params. "endpoint" should
+// be the base URL of the object store, e.g. "https://s3.example.com".
+func (sp *S3StorageProvider) Initialize(params map[string]string) error {
+	sp.endpoint = params["endpoint"]
+	sp.bucket = params["bucket"]
+	if sp.endpoint == "" {
+		return errors.New("s3provider: \"endpoint\" is required")
+	}
+	if sp.bucket == "" {
+		return errors.New("s3provider: \"bucket\" is required")
+	}
+	sp.client = http.DefaultClient
+	return nil
+}
+
+func (sp *S3StorageProvider) objectURL(address uint64) string {
+	return fmt.Sprintf("%s/%s/%s", sp.endpoint, sp.bucket, strconv.FormatUint(address, 16))
+}
+
+func (sp *S3StorageProvider) Write(address uint64, data []byte) error {
+	req, err := http.NewRequest("PUT", sp.objectURL(address), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp, err := sp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("s3provider: PUT %s: unexpected status %s", sp.objectURL(address), resp.Status)
+	}
+	return nil
+}
+
+// Read fetches the block at address and returns the (already logical)
+// contents in a newly allocated slice; buf is not used. Object stores don't impose a
+// fixed on-disk block size the way the file provider does, so there is no
+// padding to trim here.
+func (sp *S3StorageProvider) Read(address uint64, buf []byte) []byte {
+	resp, err := sp.client.Get(sp.objectURL(address))
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		panic(fmt.Errorf("s3provider: GET %s: unexpected status %s", sp.objectURL(address), resp.Status))
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	return body
+}
@@ -0,0 +1,266 @@
+package sblockstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+)
+
+var superblocksBucket = []byte("superblocks")
+var allocBucket = []byte("alloc")
+var freelistBucket = []byte("freelist")
+
+var highWaterKey = []byte("highwater")
+
+// uuidKeyLen is the length of a uuid.String() (e.g.
+// "6ba7b810-9dad-11d1-80b4-00c04fd430c8"); keys in the bucket are
+// id||big-endian-gen, so the latest generation for a given id is always the
+// last key in that id's range, and a simple byte-prefix scan finds it.
+const uuidKeyLen = 36
+
+// BoltSuperblockStore is an embedded, dependency-free SuperblockStore backed
+// by a local BoltDB file. It lets btrdb run (and, just as importantly, lets
+// its tests run) without an external Mongo deployment.
+type BoltSuperblockStore struct {
+	db *bolt.DB
+}
+
+// NewBoltSuperblockStore opens (creating if necessary) a BoltDB file at
+// path and returns a SuperblockStore backed by it.
+func NewBoltSuperblockStore(path string) (*BoltSuperblockStore, error) {
+	db, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{superblocksBucket, allocBucket, freelistBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltSuperblockStore{db: db}, nil
+}
+
+func sblockKey(id string, gen uint64) []byte {
+	key := make([]byte, uuidKeyLen+8)
+	copy(key, id)
+	binary.BigEndian.PutUint64(key[uuidKeyLen:], gen)
+	return key
+}
+
+func (b *BoltSuperblockStore) LatestFor(id string) (*SBlock, error) {
+	var sb *SBlock
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(superblocksBucket).Cursor()
+		prefix := []byte(id)
+		var lastVal []byte
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			lastVal = v
+		}
+		if lastVal == nil {
+			return nil
+		}
+		var decoded SBlock
+		if err := json.Unmarshal(lastVal, &decoded); err != nil {
+			return err
+		}
+		sb = &decoded
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sb == nil {
+		return nil, ErrNotFound
+	}
+	return sb, nil
+}
+
+func (b *BoltSuperblockStore) Get(id string, gen uint64) (*SBlock, error) {
+	var sb *SBlock
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(superblocksBucket).Get(sblockKey(id, gen))
+		if v == nil {
+			return nil
+		}
+		var decoded SBlock
+		if err := json.Unmarshal(v, &decoded); err != nil {
+			return err
+		}
+		sb = &decoded
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sb == nil {
+		return nil, ErrNotFound
+	}
+	return sb, nil
+}
+
+func (b *BoltSuperblockStore) Insert(sb *SBlock) error {
+	encoded, err := json.Marshal(sb)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(superblocksBucket).Put(sblockKey(sb.Uuid, sb.Gen), encoded)
+	})
+}
+
+func (b *BoltSuperblockStore) RangeUnlink(id string, sgen uint64, egen uint64) ([]uint64, error) {
+	var roots []uint64
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(superblocksBucket)
+		c := bucket.Cursor()
+		prefix := []byte(id)
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			gen := binary.BigEndian.Uint64(k[uuidKeyLen:])
+			if gen < sgen || gen >= egen {
+				continue
+			}
+			var sb SBlock
+			if err := json.Unmarshal(v, &sb); err != nil {
+				return err
+			}
+			if sb.Unlinked {
+				continue
+			}
+			roots = append(roots, sb.Root)
+			sb.Unlinked = true
+			encoded, err := json.Marshal(&sb)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(k, encoded); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return roots, err
+}
+
+func (b *BoltSuperblockStore) ListGenerations(id string, sgen uint64, egen uint64) ([]uint64, error) {
+	var gens []uint64
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(superblocksBucket).Cursor()
+		prefix := []byte(id)
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			gen := binary.BigEndian.Uint64(k[uuidKeyLen:])
+			if gen < sgen || gen >= egen {
+				continue
+			}
+			gens = append(gens, gen)
+		}
+		return nil
+	})
+	return gens, err
+}
+
+func (b *BoltSuperblockStore) IterateUUIDs() ([]string, error) {
+	var ids []string
+	seen := make(map[string]bool)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(superblocksBucket).ForEach(func(k, v []byte) error {
+			id := string(k[:uuidKeyLen])
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+			return nil
+		})
+	})
+	return ids, err
+}
+
+func (b *BoltSuperblockStore) DeleteUUID(id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(superblocksBucket)
+		c := bucket.Cursor()
+		prefix := []byte(id)
+		var toDelete [][]byte
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			toDelete = append(toDelete, append([]byte(nil), k...))
+		}
+		for _, k := range toDelete {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AdvanceHighWater reserves the next `batch` addresses, persisting the new
+// mark before returning so a crash after this call wastes at most one
+// batch's worth of addresses rather than leaking the counter entirely.
+func (b *BoltSuperblockStore) AdvanceHighWater(base uint64, batch uint64) (uint64, error) {
+	var reserved uint64
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(allocBucket)
+		cur := base
+		if v := bucket.Get(highWaterKey); v != nil {
+			cur = binary.BigEndian.Uint64(v)
+		}
+		reserved = cur
+		next := make([]byte, 8)
+		binary.BigEndian.PutUint64(next, cur+batch)
+		return bucket.Put(highWaterKey, next)
+	})
+	return reserved, err
+}
+
+func (b *BoltSuperblockStore) PushFree(addrs []uint64) error {
+	if len(addrs) == 0 {
+		return nil
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(freelistBucket)
+		for _, addr := range addrs {
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, addr)
+			if err := bucket.Put(key, []byte{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltSuperblockStore) PopFree(n int) ([]uint64, error) {
+	var out []uint64
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(freelistBucket)
+		c := bucket.Cursor()
+		var keys [][]byte
+		for k, _ := c.First(); k != nil && len(keys) < n; k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			out = append(out, binary.BigEndian.Uint64(k))
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (b *BoltSuperblockStore) FreeCount() (int, error) {
+	count := 0
+	err := b.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(freelistBucket).Stats().KeyN
+		return nil
+	})
+	return count, err
+}
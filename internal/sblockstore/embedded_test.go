@@ -0,0 +1,134 @@
+package sblockstore
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func newTestBoltStore(t *testing.T) *BoltSuperblockStore {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "superblocks.bolt")
+	store, err := NewBoltSuperblockStore(path)
+	if err != nil {
+		t.Fatalf("NewBoltSuperblockStore: %v", err)
+	}
+	return store
+}
+
+// TestBoltSuperblockStoreConformance exercises BoltSuperblockStore against
+// the same sequence of operations a BlockStore drives through the
+// SuperblockStore interface, so a regression here is caught without an
+// external Mongo deployment.
+func TestBoltSuperblockStoreConformance(t *testing.T) {
+	store := newTestBoltStore(t)
+	const id = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+
+	if _, err := store.LatestFor(id); err != ErrNotFound {
+		t.Fatalf("LatestFor on empty store: got %v, want ErrNotFound", err)
+	}
+
+	for gen := uint64(1); gen <= 3; gen++ {
+		if err := store.Insert(&SBlock{Uuid: id, Gen: gen, Root: gen * 100}); err != nil {
+			t.Fatalf("Insert gen %d: %v", gen, err)
+		}
+	}
+
+	latest, err := store.LatestFor(id)
+	if err != nil {
+		t.Fatalf("LatestFor: %v", err)
+	}
+	if latest.Gen != 3 || latest.Root != 300 {
+		t.Fatalf("LatestFor: got gen=%d root=%d, want gen=3 root=300", latest.Gen, latest.Root)
+	}
+
+	got, err := store.Get(id, 2)
+	if err != nil {
+		t.Fatalf("Get gen 2: %v", err)
+	}
+	if got.Root != 200 {
+		t.Fatalf("Get gen 2: got root=%d, want 200", got.Root)
+	}
+	if _, err := store.Get(id, 99); err != ErrNotFound {
+		t.Fatalf("Get missing gen: got %v, want ErrNotFound", err)
+	}
+
+	gens, err := store.ListGenerations(id, 1, 3)
+	if err != nil {
+		t.Fatalf("ListGenerations: %v", err)
+	}
+	if len(gens) != 2 {
+		t.Fatalf("ListGenerations(1,3): got %v, want [1 2]", gens)
+	}
+
+	roots, err := store.RangeUnlink(id, 1, 3)
+	if err != nil {
+		t.Fatalf("RangeUnlink: %v", err)
+	}
+	if len(roots) != 2 {
+		t.Fatalf("RangeUnlink(1,3): got %v, want 2 roots", roots)
+	}
+	// A second RangeUnlink over the same range must not re-unlink (and
+	// re-return) generations already marked unlinked.
+	roots, err = store.RangeUnlink(id, 1, 3)
+	if err != nil {
+		t.Fatalf("RangeUnlink (repeat): %v", err)
+	}
+	if len(roots) != 0 {
+		t.Fatalf("RangeUnlink repeat: got %v, want no roots", roots)
+	}
+
+	ids, err := store.IterateUUIDs()
+	if err != nil {
+		t.Fatalf("IterateUUIDs: %v", err)
+	}
+	if len(ids) != 1 || ids[0] != id {
+		t.Fatalf("IterateUUIDs: got %v, want [%s]", ids, id)
+	}
+
+	if err := store.DeleteUUID(id); err != nil {
+		t.Fatalf("DeleteUUID: %v", err)
+	}
+	if _, err := store.LatestFor(id); err != ErrNotFound {
+		t.Fatalf("LatestFor after DeleteUUID: got %v, want ErrNotFound", err)
+	}
+
+	base, err := store.AdvanceHighWater(1000, 10)
+	if err != nil {
+		t.Fatalf("AdvanceHighWater (cold): %v", err)
+	}
+	if base != 1000 {
+		t.Fatalf("AdvanceHighWater (cold): got %d, want 1000", base)
+	}
+	base, err = store.AdvanceHighWater(1000, 10)
+	if err != nil {
+		t.Fatalf("AdvanceHighWater (warm): %v", err)
+	}
+	if base != 1010 {
+		t.Fatalf("AdvanceHighWater (warm): got %d, want 1010", base)
+	}
+
+	if err := store.PushFree([]uint64{5, 6, 7}); err != nil {
+		t.Fatalf("PushFree: %v", err)
+	}
+	count, err := store.FreeCount()
+	if err != nil {
+		t.Fatalf("FreeCount: %v", err)
+	}
+	if count != 3 {
+		t.Fatalf("FreeCount: got %d, want 3", count)
+	}
+	popped, err := store.PopFree(2)
+	if err != nil {
+		t.Fatalf("PopFree: %v", err)
+	}
+	if len(popped) != 2 {
+		t.Fatalf("PopFree(2): got %v, want 2 addresses", popped)
+	}
+	count, err = store.FreeCount()
+	if err != nil {
+		t.Fatalf("FreeCount after pop: %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("FreeCount after pop: got %d, want 1", count)
+	}
+}
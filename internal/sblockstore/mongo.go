@@ -0,0 +1,165 @@
+package sblockstore
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MongoSuperblockStore is the original SuperblockStore implementation: a
+// thin wrapper around the "superblocks" collection in a Mongo database.
+type MongoSuperblockStore struct {
+	ses *mgo.Session
+	db  *mgo.Database
+}
+
+// NewMongoSuperblockStore dials targetserv and returns a SuperblockStore
+// backed by its "quasar2" database.
+func NewMongoSuperblockStore(targetserv string) (*MongoSuperblockStore, error) {
+	ses, err := mgo.Dial(targetserv)
+	if err != nil {
+		return nil, err
+	}
+	return &MongoSuperblockStore{ses: ses, db: ses.DB("quasar2")}, nil
+}
+
+func (m *MongoSuperblockStore) col() *mgo.Collection {
+	return m.db.C("superblocks")
+}
+
+func (m *MongoSuperblockStore) LatestFor(id string) (*SBlock, error) {
+	var sb SBlock
+	err := m.col().Find(bson.M{"uuid": id}).Sort("-gen").One(&sb)
+	if err == mgo.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sb, nil
+}
+
+func (m *MongoSuperblockStore) Get(id string, gen uint64) (*SBlock, error) {
+	var sb SBlock
+	err := m.col().Find(bson.M{"uuid": id, "gen": gen}).One(&sb)
+	if err == mgo.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sb, nil
+}
+
+func (m *MongoSuperblockStore) Insert(sb *SBlock) error {
+	return m.col().Insert(sb)
+}
+
+func (m *MongoSuperblockStore) RangeUnlink(id string, sgen uint64, egen uint64) ([]uint64, error) {
+	iter := m.col().Find(bson.M{"uuid": id, "gen": bson.M{"$gte": sgen, "$lt": egen}, "unlinked": false}).Iter()
+	var roots []uint64
+	var sb SBlock
+	for iter.Next(&sb) {
+		roots = append(roots, sb.Root)
+		sb.Unlinked = true
+		if _, err := m.col().Upsert(bson.M{"uuid": id, "gen": sb.Gen}, sb); err != nil {
+			iter.Close()
+			return nil, err
+		}
+	}
+	return roots, iter.Close()
+}
+
+func (m *MongoSuperblockStore) ListGenerations(id string, sgen uint64, egen uint64) ([]uint64, error) {
+	iter := m.col().Find(bson.M{"uuid": id, "gen": bson.M{"$gte": sgen, "$lt": egen}}).Select(bson.M{"gen": 1}).Iter()
+	var gens []uint64
+	var doc struct {
+		Gen uint64 `bson:"gen"`
+	}
+	for iter.Next(&doc) {
+		gens = append(gens, doc.Gen)
+	}
+	return gens, iter.Close()
+}
+
+func (m *MongoSuperblockStore) IterateUUIDs() ([]string, error) {
+	var ids []string
+	if err := m.col().Find(nil).Distinct("uuid", &ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (m *MongoSuperblockStore) DeleteUUID(id string) error {
+	_, err := m.col().RemoveAll(bson.M{"uuid": id})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (m *MongoSuperblockStore) allocCol() *mgo.Collection {
+	return m.db.C("alloc")
+}
+
+func (m *MongoSuperblockStore) freelistCol() *mgo.Collection {
+	return m.db.C("freelist")
+}
+
+type allocHighWaterDoc struct {
+	Id        string `bson:"_id"`
+	HighWater uint64 `bson:"highwater"`
+}
+
+// AdvanceHighWater atomically reserves the next `batch` addresses: a find-
+// and-modify $inc on the single "highwater" document in the "alloc"
+// collection, which a bare $inc upsert starts counting from 0. base is
+// applied as a fixed offset on the way out rather than seeded into the
+// stored value, so the update only ever touches "highwater" with a single
+// operator (Mongo rejects $setOnInsert and $inc both targeting the same
+// path) and concurrent cold-start callers still can't race each other below
+// base.
+func (m *MongoSuperblockStore) AdvanceHighWater(base uint64, batch uint64) (uint64, error) {
+	change := mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"highwater": batch}},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	var doc allocHighWaterDoc
+	if _, err := m.allocCol().FindId("highwater").Apply(change, &doc); err != nil {
+		return 0, err
+	}
+	return base + doc.HighWater - batch, nil
+}
+
+type freelistDoc struct {
+	Addr uint64 `bson:"addr"`
+}
+
+func (m *MongoSuperblockStore) PushFree(addrs []uint64) error {
+	for _, addr := range addrs {
+		if err := m.freelistCol().Insert(freelistDoc{Addr: addr}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MongoSuperblockStore) PopFree(n int) ([]uint64, error) {
+	var out []uint64
+	for i := 0; i < n; i++ {
+		var doc freelistDoc
+		change := mgo.Change{Remove: true}
+		if _, err := m.freelistCol().Find(nil).Apply(change, &doc); err != nil {
+			if err == mgo.ErrNotFound {
+				break
+			}
+			return out, err
+		}
+		out = append(out, doc.Addr)
+	}
+	return out, nil
+}
+
+func (m *MongoSuperblockStore) FreeCount() (int, error) {
+	return m.freelistCol().Count()
+}
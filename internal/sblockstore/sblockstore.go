@@ -0,0 +1,75 @@
+// Package sblockstore abstracts the superblock catalog that a BlockStore
+// uses to find the latest generation for a UUID, insert new generations and
+// unlink old ones. Everything here used to be an ad-hoc collection of
+// bs.db.C("superblocks") calls directly against Mongo; pulling it behind an
+// interface lets a BlockStore run against Mongo or a dependency-free
+// embedded store without the tree-manipulation code caring which.
+package sblockstore
+
+import "errors"
+
+// ErrNotFound is returned by Get/LatestFor when no matching superblock
+// exists (instead of a not-found sentinel from whatever database backs the
+// implementation).
+var ErrNotFound = errors.New("sblockstore: superblock not found")
+
+// SBlock is the catalog's view of a single generation of a single stream's
+// tree: just enough to resume writing (Root, Gen) or to know a generation
+// has been superseded (Unlinked).
+type SBlock struct {
+	Uuid     string
+	Gen      uint64
+	Root     uint64
+	Unlinked bool
+}
+
+// SuperblockStore is the catalog of superblocks for every UUID known to a
+// BlockStore. Implementations must be safe for concurrent use.
+type SuperblockStore interface {
+	// LatestFor returns the highest-generation SBlock for id, or
+	// ErrNotFound if none exists.
+	LatestFor(id string) (*SBlock, error)
+
+	// Get returns the SBlock for id at exactly generation gen, or
+	// ErrNotFound if none exists.
+	Get(id string, gen uint64) (*SBlock, error)
+
+	// Insert adds a newly committed SBlock to the catalog.
+	Insert(sb *SBlock) error
+
+	// RangeUnlink marks every SBlock for id with sgen <= gen < egen as
+	// unlinked, and returns the root address of each one it unlinked (so the
+	// caller can push them onto the free list).
+	RangeUnlink(id string, sgen uint64, egen uint64) ([]uint64, error)
+
+	// ListGenerations returns the generation number of every SBlock for id
+	// with sgen <= gen < egen, in no particular order. Generation numbers
+	// are sparse, so this is how a caller enumerates what actually exists in
+	// a range instead of probing every integer in [sgen, egen).
+	ListGenerations(id string, sgen uint64, egen uint64) ([]uint64, error)
+
+	// IterateUUIDs returns every distinct UUID string with at least one
+	// SBlock in the catalog.
+	IterateUUIDs() ([]string, error)
+
+	// DeleteUUID removes every SBlock for id from the catalog.
+	DeleteUUID(id string) error
+
+	// AdvanceHighWater atomically reserves the next `batch` addresses from
+	// the allocator's high-water mark, persists the new mark, and returns
+	// the first address of the reserved range. It is how the allocator
+	// refills in batches rather than persisting on every single allocation.
+	AdvanceHighWater(base uint64, batch uint64) (uint64, error)
+
+	// PushFree adds addresses to the persisted free list, for reuse by a
+	// later AdvanceHighWater-avoiding allocation.
+	PushFree(addrs []uint64) error
+
+	// PopFree removes and returns up to n addresses from the persisted free
+	// list (fewer, or none, if it doesn't have that many).
+	PopFree(n int) ([]uint64, error)
+
+	// FreeCount returns the number of addresses currently on the persisted
+	// free list.
+	FreeCount() (int, error)
+}